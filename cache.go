@@ -0,0 +1,231 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import "sync"
+
+// cacheEntry is one node of the pageCache LRU list, holding the raw bytes
+// of a single pageSize-aligned chunk of the backing File.
+type cacheEntry struct {
+	off        int64
+	data       []byte
+	prev, next *cacheEntry
+}
+
+// pageCache is a bounded, size-limited LRU cache of pageSize-aligned
+// chunks, keyed by their offset within the backing File. It sits in front
+// of openPage, openNode and read so that allocation heavy workloads do not
+// turn every node/page touch into a syscall.
+//
+// Allocator.mu does not give pageCache mutual exclusion on its own: View
+// takes only a read lock, and is documented to let concurrent View calls
+// run without blocking each other, so reads that share a pageCache must
+// still serialize against one another. pageCache therefore guards its own
+// map and LRU list with mu.
+type pageCache struct {
+	mu           sync.Mutex
+	limit        int64
+	size         int64
+	entries      map[int64]*cacheEntry
+	mru, lru     *cacheEntry
+	hits, misses int64
+}
+
+func newPageCache(limit int64) *pageCache {
+	return &pageCache{limit: limit, entries: map[int64]*cacheEntry{}}
+}
+
+func (c *pageCache) unlink(e *cacheEntry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		c.mru = e.next
+	}
+
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		c.lru = e.prev
+	}
+
+	e.prev, e.next = nil, nil
+}
+
+func (c *pageCache) pushFront(e *cacheEntry) {
+	e.next = c.mru
+	if c.mru != nil {
+		c.mru.prev = e
+	}
+	c.mru = e
+	if c.lru == nil {
+		c.lru = e
+	}
+}
+
+// get returns a copy of the cached chunk at off, if any, moving it to the
+// front of the LRU list. The copy is taken under c.mu so the caller never
+// observes a chunk a concurrent write is in the middle of mutating.
+func (c *pageCache) get(off int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[off]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	if e != c.mru {
+		c.unlink(e)
+		c.pushFront(e)
+	}
+
+	b := make([]byte, len(e.data))
+	copy(b, e.data)
+	return b, true
+}
+
+// put inserts or replaces the chunk at off, evicting least recently used
+// chunks until the cache is again within its byte limit.
+func (c *pageCache) put(off int64, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[off]; ok {
+		c.size += int64(len(data) - len(e.data))
+		e.data = data
+		if e != c.mru {
+			c.unlink(e)
+			c.pushFront(e)
+		}
+	} else {
+		e := &cacheEntry{off: off, data: data}
+		c.entries[off] = e
+		c.pushFront(e)
+		c.size += int64(len(data))
+	}
+
+	for c.size > c.limit && c.lru != nil {
+		victim := c.lru
+		c.unlink(victim)
+		delete(c.entries, victim.off)
+		c.size -= int64(len(victim.data))
+	}
+}
+
+// write copies b into rel..rel+len(b) of the cached chunk at off, if one is
+// cached and b fits within it; otherwise it evicts the chunk, if any, so a
+// later read falls through to the backing File instead of serving stale
+// data.
+func (c *pageCache) write(off int64, rel int, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[off]
+	if !ok {
+		return
+	}
+
+	if rel < 0 || rel+len(b) > len(e.data) {
+		c.evictLocked(off)
+		return
+	}
+
+	copy(e.data[rel:], b)
+}
+
+// evict drops the chunk at off, if cached.
+func (c *pageCache) evict(off int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.evictLocked(off)
+}
+
+func (c *pageCache) evictLocked(off int64) {
+	e, ok := c.entries[off]
+	if !ok {
+		return
+	}
+
+	c.unlink(e)
+	delete(c.entries, off)
+	c.size -= int64(len(e.data))
+}
+
+// evictFrom drops every cached chunk at or beyond off. Allocator calls this
+// after Truncate shrinks the backing File, so stale chunks past the new
+// fsize are never served again.
+func (c *pageCache) evictFrom(off int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k := range c.entries {
+		if k >= off {
+			c.evictLocked(k)
+		}
+	}
+}
+
+// chunkBase returns the pageSize-aligned chunk offset, relative to szFile,
+// that covers off. Every page starts at such a boundary, so this is also
+// the cache key used for reads and writes that fall anywhere within it.
+func (a *Allocator) chunkBase(off int64) int64 { return (off-szFile)&^pageMask + szFile }
+
+// readCached reads n bytes at off, consulting and maintaining the page
+// cache when one is configured.
+func (a *Allocator) readCached(off int64, n int) ([]byte, error) {
+	if a.cache == nil {
+		b := make([]byte, n)
+		if _, err := a.f.ReadAt(b, off); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	base := a.chunkBase(off)
+	chunk, ok := a.cache.get(base)
+	if !ok {
+		sz := int64(pageSize)
+		if base+sz > a.fsize {
+			sz = a.fsize - base
+		}
+
+		chunk = make([]byte, sz)
+		if _, err := a.f.ReadAt(chunk, base); err != nil {
+			return nil, err
+		}
+		a.cache.put(base, chunk)
+	}
+
+	rel := int(off - base)
+	if rel < 0 || rel+n > len(chunk) {
+		b := make([]byte, n)
+		if _, err := a.f.ReadAt(b, off); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+
+	return chunk[rel : rel+n], nil
+}
+
+// writeCached writes b at off and, when a page cache is configured, keeps
+// any chunk covering off consistent with what was just written instead of
+// invalidating it.
+func (a *Allocator) writeCached(off int64, b []byte) error {
+	if _, err := a.f.WriteAt(b, off); err != nil {
+		return err
+	}
+
+	if a.cache == nil {
+		return nil
+	}
+
+	base := a.chunkBase(off)
+	a.cache.write(base, int(off-base), b)
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func cachingOptions() *AllocatorOptions {
+	opts := NewAllocatorOptions()
+	opts.CacheBytes = 1 << 20
+	return opts
+}
+
+// TestPageCacheSurvivesRealloc checks that a block's content reads back
+// correctly, via the cache, both before and after a Realloc moves it.
+func TestPageCacheSurvivesRealloc(t *testing.T) {
+	a, cleanup := newTestAllocator(t, cachingOptions())
+	defer cleanup()
+
+	off, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Repeat([]byte{0x11}, 2000)
+	if _, err := a.WriteAt(off, want); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 2000)
+	if _, err := a.ReadAt(off, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadAt before Realloc: got %x, want %x", got, want)
+	}
+
+	off2, err := a.Realloc(off, 5000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = make([]byte, 2000)
+	if _, err := a.ReadAt(off2, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadAt after Realloc: got %x, want %x", got, want)
+	}
+}
+
+// TestPageCacheEvictsOnTruncate checks that freeing the last page, which
+// truncates the backing File, drops any cached chunk at or beyond the new
+// end of file so a later allocation at the same offset never reads back
+// stale cached bytes left over from the freed page.
+func TestPageCacheEvictsOnTruncate(t *testing.T) {
+	a, cleanup := newTestAllocator(t, cachingOptions())
+	defer cleanup()
+
+	off, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := bytes.Repeat([]byte{0xff}, 2000)
+	if _, err := a.WriteAt(off, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	// Populate the cache with off's chunk before it is freed.
+	got := make([]byte, 2000)
+	if _, err := a.ReadAt(off, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Free(off); err != nil {
+		t.Fatal(err)
+	}
+
+	off2, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if off2 != off {
+		t.Skip("allocator did not reuse the truncated offset; nothing to check")
+	}
+
+	want := make([]byte, 2000)
+	got = make([]byte, 2000)
+	if _, err := a.ReadAt(off2, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadAt of a fresh Calloc after truncation: got %x, want zeros", got)
+	}
+}
+
+// TestPageCacheEvictsOnFree checks that freeing a page that is not the
+// file's last page, and so does not truncate, still makes the allocator
+// reuse it cleanly: the content of a subsequent Calloc at the same offset
+// must be the freshly zeroed bytes, not whatever was cached for the
+// previous occupant.
+func TestPageCacheEvictsOnFree(t *testing.T) {
+	a, cleanup := newTestAllocator(t, cachingOptions())
+	defer cleanup()
+
+	off, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anchor, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale := bytes.Repeat([]byte{0xff}, 2000)
+	if _, err := a.WriteAt(off, stale); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 2000)
+	if _, err := a.ReadAt(off, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Free(off); err != nil {
+		t.Fatal(err)
+	}
+
+	off2, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if off2 != off {
+		t.Skip("allocator did not reuse the freed offset; nothing to check")
+	}
+
+	want := make([]byte, 2000)
+	got = make([]byte, 2000)
+	if _, err := a.ReadAt(off2, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadAt of a fresh Calloc reusing a freed offset: got %x, want zeros", got)
+	}
+
+	if err := a.Free(anchor); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestConcurrentView exercises the page cache under concurrent, blocking-
+// free View calls, as tx.go's doc comment promises. Run with -race, this
+// is a regression test for pageCache having no locking of its own.
+func TestConcurrentView(t *testing.T) {
+	a, cleanup := newTestAllocator(t, cachingOptions())
+	defer cleanup()
+
+	var offs []int64
+	for i := 0; i < 8; i++ {
+		off, err := a.Calloc(500)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := a.WriteAt(off, bytes.Repeat([]byte{byte(i)}, 500)); err != nil {
+			t.Fatal(err)
+		}
+
+		offs = append(offs, off)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < 50; i++ {
+				err := a.View(func(tx *Tx) error {
+					b := make([]byte, 500)
+					_, err := tx.ReadAt(offs[i%len(offs)], b)
+					return err
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,232 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import "fmt"
+
+// Page kinds, stored in page.kind. A page is pageRaw unless compression is
+// configured and WriteAt decided otherwise for it.
+const (
+	pageRaw            = iota // The page directly holds the block payload.
+	pageCompressed            // The page holds a compressed block; logical holds the decompressed size.
+	pageRelocationStub        // The block was moved; the payload area holds the offset of the page now holding it.
+)
+
+// AllocatorOptions configure optional Allocator features that are off by
+// default: transparent compression and page caching.
+// The zero value of AllocatorOptions disables every optional feature.
+type AllocatorOptions struct {
+	// CompressThreshold is the block size, in bytes, Alloc-level writes
+	// must exceed before WriteAt attempts to compress them. Zero, or a nil
+	// Compressor, disables compression.
+	CompressThreshold int64
+
+	// Compressor compresses a block. It must not retain b.
+	Compressor func(b []byte) ([]byte, error)
+
+	// Decompressor decompresses src into dst, which is sized to exactly
+	// hold the decompressed payload.
+	Decompressor func(dst, src []byte) error
+
+	// CacheBytes bounds the size, in bytes, of the in-memory LRU page
+	// cache placed in front of the backing File. Zero disables the cache.
+	CacheBytes int64
+}
+
+// NewAllocatorOptions returns a new AllocatorOptions with every optional
+// feature disabled.
+func NewAllocatorOptions() *AllocatorOptions { return &AllocatorOptions{} }
+
+// ReadAt reads the block allocated at off, which must have been returned
+// from Alloc or Realloc, into b, starting at the beginning of the block.
+// Compressed and relocated blocks are resolved and decompressed
+// transparently. ReadAt is safe for concurrent use by multiple goroutines.
+func (a *Allocator) ReadAt(off int64, b []byte) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.readAt(off, b)
+}
+
+func (a *Allocator) readAt(off int64, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	p, err := a.openPage((off - szFile) &^ pageMask + szFile)
+	if err != nil {
+		return 0, err
+	}
+
+	if p.rank <= maxSharedRank {
+		return a.f.ReadAt(b, off)
+	}
+
+	blockStart := p.off + szPage
+	rel := off - blockStart
+
+	switch p.kind {
+	case pageRelocationStub:
+		target, err := a.read(blockStart)
+		if err != nil {
+			return 0, err
+		}
+
+		tp, err := a.openPage(target)
+		if err != nil {
+			return 0, err
+		}
+
+		return a.readBlock(tp, rel, b)
+	default:
+		return a.readBlock(p, rel, b)
+	}
+}
+
+// WriteAt writes the whole logical content of the block allocated at off,
+// which must have been returned from Alloc or Realloc, from b, replacing
+// its current content. If compression is configured and len(b) exceeds
+// options.CompressThreshold, the block is compressed and, if that shrinks
+// it by at least one rank, relocated to a smaller page; the original
+// handle then holds a relocation stub. WriteAt is safe for concurrent use
+// by multiple goroutines.
+func (a *Allocator) WriteAt(off int64, b []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.writeAt(off, b)
+}
+
+func (a *Allocator) writeAt(off int64, b []byte) (int, error) {
+	p, err := a.openPage((off - szFile) &^ pageMask + szFile)
+	if err != nil {
+		return 0, err
+	}
+
+	if p.rank <= maxSharedRank {
+		return a.f.WriteAt(b, off)
+	}
+
+	if off != p.off+szPage {
+		if p.kind != pageRaw {
+			return 0, fmt.Errorf("invalid argument: %T.WriteAt(%#x): partial write of a compressed or relocated block", a, off)
+		}
+
+		return a.f.WriteAt(b, off)
+	}
+
+	if p.kind == pageRelocationStub {
+		if err := a.freeRelocationTarget(off); err != nil {
+			return 0, err
+		}
+
+		p.setKind(pageRaw)
+	}
+
+	opts := a.options
+	if opts.Compressor == nil || opts.CompressThreshold <= 0 || int64(len(b)) <= opts.CompressThreshold {
+		if p.kind == pageCompressed {
+			p.setKind(pageRaw)
+			p.setLogical(0)
+		}
+		// Also persists a relocation stub's switch to pageRaw, above.
+		if err := p.flush(); err != nil {
+			return 0, err
+		}
+
+		return a.f.WriteAt(b, off)
+	}
+
+	compressed, err := opts.Compressor(b)
+	if err != nil {
+		return 0, err
+	}
+
+	need := roundup64(szPage+int64(len(compressed))+szTail, pageSize)
+	if newRank := pageRank(need); newRank < int(p.rank) {
+		return a.relocateCompressed(p, b, compressed)
+	}
+
+	if p.kind != pageCompressed {
+		p.setKind(pageCompressed)
+	}
+	p.setLogical(int64(len(b)))
+	if err := p.flush(); err != nil {
+		return 0, err
+	}
+
+	return a.f.WriteAt(compressed, off)
+}
+
+// readBlock reads rel..rel+len(b) of p's logical content into b, resolving
+// compression if necessary.
+func (a *Allocator) readBlock(p *memPage, rel int64, b []byte) (int, error) {
+	if p.kind != pageCompressed {
+		return a.f.ReadAt(b, p.off+szPage+rel)
+	}
+
+	if a.options.Decompressor == nil {
+		return 0, fmt.Errorf("internal error: %T.ReadAt: compressed block without a Decompressor", a)
+	}
+
+	src := make([]byte, p.size-szPage-szTail)
+	if _, err := a.f.ReadAt(src, p.off+szPage); err != nil {
+		return 0, err
+	}
+
+	dst := make([]byte, p.logical)
+	if err := a.options.Decompressor(dst, src); err != nil {
+		return 0, err
+	}
+
+	return copy(b, dst[rel:]), nil
+}
+
+// relocateCompressed stores the compressed form of b in a freshly allocated,
+// smaller page and turns the page at off (p) into a relocation stub
+// pointing at it.
+func (a *Allocator) relocateCompressed(p *memPage, b, compressed []byte) (int, error) {
+	q, err := a.newPage(int64(len(compressed)))
+	if err != nil {
+		return 0, err
+	}
+
+	q.setKind(pageCompressed)
+	q.setLogical(int64(len(b)))
+	if err := q.flush(); err != nil {
+		return 0, err
+	}
+
+	if _, err := a.f.WriteAt(compressed, q.off+szPage); err != nil {
+		return 0, err
+	}
+
+	p.setKind(pageRelocationStub)
+	if err := p.flush(); err != nil {
+		return 0, err
+	}
+
+	target := make([]byte, szTail)
+	write(target, q.off)
+	if err := a.writeCached(p.off+szPage, target); err != nil {
+		return 0, err
+	}
+
+	a.relocations++
+	return len(b), a.flush()
+}
+
+// freeRelocationTarget reclaims the page a relocation stub at off points to.
+func (a *Allocator) freeRelocationTarget(off int64) error {
+	target, err := a.read(off)
+	if err != nil {
+		return err
+	}
+
+	tp, err := a.openPage(target)
+	if err != nil {
+		return err
+	}
+
+	return a.freePage(tp)
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+// Defragment opportunistically merges physically adjacent free big pages
+// (rank > maxSharedRank) into a single, larger free page, reducing the
+// fragmentation churny alloc/free workloads tend to leave behind. It
+// performs at most maxWork coalesce operations and returns how many it
+// actually did, so callers can amortize defragmentation across many calls
+// instead of paying for it all at once. Defragment is safe for concurrent
+// use by multiple goroutines.
+func (a *Allocator) Defragment(maxWork int) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	coalesced := 0
+	for rank := firstPageRank; rank < ranks && coalesced < maxWork; {
+		off := a.pages[rank]
+		progressed := false
+		for off != 0 && coalesced < maxWork {
+			p, err := a.openPage(off)
+			if err != nil {
+				return coalesced, err
+			}
+
+			next := p.next
+			merged, err := a.coalesceForward(p)
+			if err != nil {
+				return coalesced, err
+			}
+
+			if !merged {
+				merged, err = a.coalesceBackward(p)
+				if err != nil {
+					return coalesced, err
+				}
+			}
+
+			if !merged {
+				off = next
+				continue
+			}
+
+			coalesced++
+			progressed = true
+			// The list we were walking just lost one or two nodes and
+			// possibly gained a differently ranked one; re-scan this
+			// rank's list from its head rather than trust stale links.
+			off = a.pages[rank]
+		}
+
+		if !progressed {
+			rank++
+		}
+	}
+	return coalesced, nil
+}
+
+// coalesceForward merges p with its immediate physical successor, if that
+// page is also a free big page.
+func (a *Allocator) coalesceForward(p *memPage) (bool, error) {
+	nextOff := p.off + p.size
+	if nextOff >= a.fsize {
+		return false, nil
+	}
+
+	next, err := a.openPage(nextOff)
+	if err != nil {
+		return false, err
+	}
+
+	if next.rank <= maxSharedRank {
+		return false, nil
+	}
+
+	tail, err := a.read(nextOff + next.size - szTail)
+	if err != nil {
+		return false, err
+	}
+
+	if tail != next.size {
+		return false, nil
+	}
+
+	return true, a.mergePages(p, next)
+}
+
+// coalesceBackward merges p with its immediate physical predecessor, if
+// that page is also a free big page. It reuses the tail-size convention
+// freeLastPage relies on to find and size the predecessor.
+func (a *Allocator) coalesceBackward(p *memPage) (bool, error) {
+	if p.off <= szFile {
+		return false, nil
+	}
+
+	prevSize, err := a.read(p.off - szTail)
+	if err != nil {
+		return false, err
+	}
+
+	if prevSize == 0 {
+		return false, nil
+	}
+
+	prev, err := a.openPage(p.off - prevSize)
+	if err != nil {
+		return false, err
+	}
+
+	if prev.rank <= maxSharedRank {
+		return false, nil
+	}
+
+	return true, a.mergePages(prev, p)
+}
+
+// mergePages unlinks lo and hi, two physically adjacent free big pages
+// with lo.off < hi.off, from their free lists and replaces them with a
+// single free page at lo.off spanning both.
+func (a *Allocator) mergePages(lo, hi *memPage) error {
+	if err := lo.unlink(); err != nil {
+		return err
+	}
+
+	// lo and hi are commonly neighbors on the same free list, in which
+	// case lo.unlink, above, already rewrote hi's on-disk prev/next
+	// through a page object of its own; re-read hi so its unlink below
+	// acts on current links instead of the ones it was opened with.
+	hi, err := a.openPage(hi.off)
+	if err != nil {
+		return err
+	}
+
+	if err := hi.unlink(); err != nil {
+		return err
+	}
+
+	lo.setSize(lo.size + hi.size)
+	lo.setRank(int64(pageRank(lo.size)))
+	if err := a.insertPage(lo); err != nil {
+		return err
+	}
+
+	if err := lo.flush(); err != nil {
+		return err
+	}
+
+	return lo.setTail(lo.size)
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import "testing"
+
+// TestDefragmentCoalescesAdjacentFreePages frees two physically adjacent
+// big pages, keeping the file from truncating them away by leaving a third,
+// live allocation right after them, then checks that Defragment merges the
+// two into one free page without losing or gaining any accounted bytes.
+func TestDefragmentCoalescesAdjacentFreePages(t *testing.T) {
+	a, cleanup := newTestAllocator(t, nil)
+	defer cleanup()
+
+	off1, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	off2, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	anchor, err := a.Calloc(2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Free(off1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Free(off2); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := a.Verify(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before.FreePages < 2 {
+		t.Fatalf("setup: FreePages %v, want at least 2 adjacent free pages to coalesce", before.FreePages)
+	}
+
+	n, err := a.Defragment(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n == 0 {
+		t.Fatal("Defragment: coalesced 0 pages, want at least 1")
+	}
+
+	after, err := a.Verify(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.FreePages != before.FreePages-int64(n) {
+		t.Fatalf("Verify after Defragment: FreePages %v, want %v (before %v minus %v coalesced)", after.FreePages, before.FreePages-int64(n), before.FreePages, n)
+	}
+
+	if after.FreeBytes != before.FreeBytes {
+		t.Fatalf("Verify after Defragment: FreeBytes %v, want %v (unchanged)", after.FreeBytes, before.FreeBytes)
+	}
+
+	if after.AllocPages != before.AllocPages || after.AllocBytes != before.AllocBytes {
+		t.Fatalf("Verify after Defragment: live allocation accounting changed: AllocPages %v->%v, AllocBytes %v->%v", before.AllocPages, after.AllocPages, before.AllocBytes, after.AllocBytes)
+	}
+
+	if err := a.Free(anchor); err != nil {
+		t.Fatal(err)
+	}
+}
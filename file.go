@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"unsafe"
 
 	"github.com/cznic/internal/buffer"
@@ -33,6 +34,8 @@ const (
 	oPageRank     = int64(unsafe.Offsetof(page{}.rank))
 	oPageSize     = int64(unsafe.Offsetof(page{}.size))
 	oPageUsed     = int64(unsafe.Offsetof(page{}.used))
+	oPageKind     = int64(unsafe.Offsetof(page{}.kind))
+	oPageLogical  = int64(unsafe.Offsetof(page{}.logical))
 	pageAvail     = pageSize - szPage - szTail
 	pageLog       = 12
 	pageMask      = pageSize - 1
@@ -149,7 +152,7 @@ func (m *memNode) flush() error {
 	b := *p
 	write(b[oNodeNext:], m.next)
 	write(b[oNodePrev:], m.prev)
-	_, err := m.f.WriteAt(b, m.off)
+	err := m.writeCached(m.off, b)
 	m.dirty = err == nil
 	buffer.Put(p)
 	return err
@@ -193,9 +196,11 @@ func (m *memNode) unlink(rank int) error {
 type page struct {
 	brk int64
 	node
-	rank int64
-	size int64
-	used int64
+	rank    int64
+	size    int64
+	used    int64
+	kind    int64 // One of pageRaw, pageCompressed or pageRelocationStub.
+	logical int64 // Decompressed size, valid when kind == pageCompressed.
 }
 
 type memPage struct {
@@ -218,7 +223,9 @@ func (m *memPage) flush() error {
 	write(b[oPageRank:], m.rank)
 	write(b[oPageSize:], m.size)
 	write(b[oPageUsed:], m.used)
-	_, err := m.f.WriteAt(b, m.off)
+	write(b[oPageKind:], m.kind)
+	write(b[oPageLogical:], m.logical)
+	err := m.writeCached(m.off, b)
 	m.dirty = err == nil
 	buffer.Put(p)
 	return err
@@ -256,13 +263,15 @@ func (m *memPage) setTail(n int64) error {
 	p := buffer.Get(8)
 	b := *p
 	write(b, n)
-	_, err := m.f.WriteAt(b, m.off+m.size-szTail)
+	err := m.writeCached(m.off+m.size-szTail, b)
 	buffer.Put(p)
 	return err
 }
 
-func (m *memPage) setUsed(n int64)  { m.used = n; m.dirty = true }
-func (m *memPage) slot(i int) int64 { return m.off + szPage + int64(i)<<uint(m.rank+4) }
+func (m *memPage) setUsed(n int64)    { m.used = n; m.dirty = true }
+func (m *memPage) setKind(n int64)    { m.kind = n; m.dirty = true }
+func (m *memPage) setLogical(n int64) { m.logical = n; m.dirty = true }
+func (m *memPage) slot(i int) int64   { return m.off + szPage + int64(i)<<uint(m.rank+4) }
 
 func (m *memPage) split(need int64) (int64, error) {
 	if m.rank <= maxSharedRank {
@@ -360,28 +369,45 @@ type testStat struct {
 
 // Allocator manages allocation of file blocks within a File.
 type Allocator struct {
-	buf   []byte
-	bufp  *[]byte
-	cap   [slotRanks]int
-	dirty bool
-	f     File
+	buf         []byte
+	bufp        *[]byte
+	cache       *pageCache // nil unless options.CacheBytes > 0.
+	cap         [slotRanks]int
+	dirty       bool
+	f           File
 	file
-	fsize int64
+	fsize       int64
+	inTx        bool // Set for the duration of a write transaction; see flush.
+	mu          sync.RWMutex // Guards pages, slots, fsize and everything reachable through them.
+	options     *AllocatorOptions
+	relocations int64 // Number of blocks moved to a smaller page by compression.
 	testStat
 }
 
 // NewAllocator returns a newly created Allocator managing f or an eror, if
 // any. Allocator never touches the first 16 bytes within f.
-func NewAllocator(f File) (*Allocator, error) {
+//
+// opts configures optional features, like transparent compression. A nil
+// opts is equivalent to NewAllocatorOptions(), ie. all optional features
+// disabled.
+func NewAllocator(f File, opts *AllocatorOptions) (*Allocator, error) {
 	fi, err := f.Stat()
 	if err != nil {
 		return nil, err
 	}
 
+	if opts == nil {
+		opts = NewAllocatorOptions()
+	}
+
 	a := &Allocator{
-		bufp:  buffer.CGet(int(szFile - oFileSkip)),
-		f:     f,
-		fsize: fi.Size(),
+		bufp:    buffer.CGet(int(szFile - oFileSkip)),
+		f:       f,
+		fsize:   fi.Size(),
+		options: opts,
+	}
+	if opts.CacheBytes > 0 {
+		a.cache = newPageCache(opts.CacheBytes)
 	}
 	a.buf = *a.bufp
 	for i := range a.cap {
@@ -414,8 +440,15 @@ func NewAllocator(f File) (*Allocator, error) {
 }
 
 // Alloc allocates a file block large enough for storing size bytes and returns
-// its offset or an error, if any.
+// its offset or an error, if any. Alloc is safe for concurrent use by
+// multiple goroutines.
 func (a *Allocator) Alloc(size int64) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.alloc(size)
+}
+
+func (a *Allocator) alloc(size int64) (int64, error) {
 	if size <= 0 {
 		return -1, fmt.Errorf("invalid argument: %T.Alloc(%v)", a, size)
 	}
@@ -457,8 +490,12 @@ func (a *Allocator) Alloc(size int64) (int64, error) {
 }
 
 // Calloc is like Alloc but the allocated file block is zeroed up to size.
+// Calloc is safe for concurrent use by multiple goroutines.
 func (a *Allocator) Calloc(size int64) (int64, error) {
-	off, err := a.Alloc(size)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	off, err := a.alloc(size)
 	if err != nil {
 		return -1, err
 	}
@@ -485,6 +522,9 @@ func (a *Allocator) Calloc(size int64) (int64, error) {
 
 // Close closes a and its underlying File.
 func (a *Allocator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
 	if err := a.flush(); err != nil {
 		return err
 	}
@@ -493,8 +533,15 @@ func (a *Allocator) Close() error {
 	return a.f.Close()
 }
 
-// Free recycles the allocated file block at off.
+// Free recycles the allocated file block at off. Free is safe for
+// concurrent use by multiple goroutines.
 func (a *Allocator) Free(off int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.free(off)
+}
+
+func (a *Allocator) free(off int64) error {
 	if off < szFile+szPage {
 		return fmt.Errorf("invalid argument: %T.Free(%v)", a, off)
 	}
@@ -506,6 +553,12 @@ func (a *Allocator) Free(off int64) error {
 	}
 
 	if p.rank > maxSharedRank {
+		if p.kind == pageRelocationStub {
+			if err := a.freeRelocationTarget(off); err != nil {
+				return err
+			}
+		}
+
 		if err := a.freePage(p); err != nil {
 			return err
 		}
@@ -538,14 +591,21 @@ func (a *Allocator) Free(off int64) error {
 // relocated file block or an error, if any. The contents will be unchanged in
 // the range from the start of the region up to the minimum of the old and new
 // sizes. Realloc(off, 0) is equal to Free(off). If the file block was moved, a
-// Free(off) is done.
+// Free(off) is done. Realloc is safe for concurrent use by multiple
+// goroutines.
 func (a *Allocator) Realloc(off, size int64) (int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.realloc(off, size)
+}
+
+func (a *Allocator) realloc(off, size int64) (int64, error) {
 	if off < szFile+szPage {
 		return -1, fmt.Errorf("invalid argument: %T.Realloc(%v)", a, off)
 	}
 
 	if size == 0 {
-		return -1, a.Free(off)
+		return -1, a.free(off)
 	}
 
 	oldSize, p, err := a.usableSize(off)
@@ -553,7 +613,7 @@ func (a *Allocator) Realloc(off, size int64) (int64, error) {
 		return -1, err
 	}
 
-	if oldSize >= size {
+	if oldSize >= size && p.kind == pageRaw {
 		newRank := rank(size)
 		if int(p.rank) == newRank {
 			return off, nil
@@ -566,7 +626,7 @@ func (a *Allocator) Realloc(off, size int64) (int64, error) {
 		}
 	}
 
-	newOff, err := a.Alloc(size)
+	newOff, err := a.alloc(size)
 	if err != nil {
 		return -1, err
 	}
@@ -577,7 +637,17 @@ func (a *Allocator) Realloc(off, size int64) (int64, error) {
 	src := off
 	dst := newOff
 	for rem != 0 {
-		n, err := a.f.ReadAt(b, src)
+		rq := len(b)
+		if rem < int64(rq) {
+			rq = int(rem)
+		}
+
+		// src may be compressed or relocated; readAt resolves that
+		// transparently. dst is a freshly allocated, still pageRaw
+		// page, so a plain write is correct and, unlike writeAt, does
+		// not risk mistaking one chunk of a larger copy for the whole
+		// logical block and compressing just that chunk.
+		n, err := a.readAt(src, b[:rq])
 		if n == 0 {
 			return -1, err
 		}
@@ -591,13 +661,17 @@ func (a *Allocator) Realloc(off, size int64) (int64, error) {
 		rem -= int64(n)
 	}
 	buffer.Put(q)
-	return newOff, a.Free(off)
+	return newOff, a.free(off)
 }
 
 // UsableSize reports the size of the file block allocated at off, which must
 // have been returned from Alloc or Realloc.  The allocated file block size can
 // be larger than the size originally requested from Alloc or Realloc.
+// UsableSize is safe for concurrent use by multiple goroutines.
 func (a *Allocator) UsableSize(off int64) (int64, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
 	n, _, err := a.usableSize(off)
 	return n, err
 }
@@ -730,11 +804,19 @@ func (a *Allocator) check(n, min, max int64) (int64, error) {
 	return n, nil
 }
 
+// flush writes the file header (the free page/slot list roots) to disk,
+// unless a write transaction is in progress, in which case the write is
+// deferred to that transaction's Commit so the header is only ever updated
+// once the whole batch of changes it describes is final.
 func (a *Allocator) flush() error {
-	if !a.dirty {
+	if !a.dirty || a.inTx {
 		return nil
 	}
 
+	return a.flushHeader()
+}
+
+func (a *Allocator) flushHeader() error {
 	for i, v := range a.pages {
 		write(a.buf[int(oFilePages-oFileSkip)+8*i:], v)
 	}
@@ -765,6 +847,10 @@ func (a *Allocator) freeLastPage(p *memPage) error {
 			return err
 		}
 
+		if a.cache != nil {
+			a.cache.evictFrom(p.off)
+		}
+
 		a.fsize = p.off
 		a.npages--
 		a.bytes -= p.size
@@ -806,6 +892,15 @@ func (a *Allocator) freePage(p *memPage) error {
 
 		p.setBrk(0)
 		p.setRank(firstPageRank)
+	} else if p.kind != pageRaw {
+		// A freed big page is handed back out by allocBig2/allocMaxRank
+		// without going through WriteAt, so a stale pageCompressed or
+		// pageRelocationStub kind would otherwise survive into the next
+		// allocation. Callers are responsible for freeing whatever a
+		// relocation stub points to before reaching here; just clear the
+		// kind/logical bookkeeping.
+		p.setKind(pageRaw)
+		p.setLogical(0)
 	}
 	if err := a.insertPage(p); err != nil {
 		return err
@@ -883,32 +978,28 @@ func (a *Allocator) newSharedPage(rank int) (*memPage, error) {
 }
 
 func (a *Allocator) openNode(off int64) (*memNode, error) {
-	p := buffer.Get(int(szNode))
-	b := *p
-	if n, err := a.f.ReadAt(b, off); n != len(b) {
+	b, err := a.readCached(off, int(szNode))
+	if err != nil {
 		return nil, err
 	}
 
-	m := &memNode{
+	return &memNode{
 		Allocator: a,
 		off:       off,
 		node: node{
 			next: read(b[oNodeNext:]),
 			prev: read(b[oNodePrev:]),
 		},
-	}
-	buffer.Put(p)
-	return m, nil
+	}, nil
 }
 
 func (a *Allocator) openPage(off int64) (*memPage, error) {
-	p := buffer.Get(int(szPage))
-	b := *p
-	if n, err := a.f.ReadAt(b, off); n != len(b) {
+	b, err := a.readCached(off, int(szPage))
+	if err != nil {
 		return nil, err
 	}
 
-	m := &memPage{
+	return &memPage{
 		Allocator: a,
 		off:       off,
 		page: page{
@@ -917,25 +1008,22 @@ func (a *Allocator) openPage(off int64) (*memPage, error) {
 				next: read(b[oPageNext:]),
 				prev: read(b[oPagePrev:]),
 			},
-			rank: read(b[oPageRank:]),
-			size: read(b[oPageSize:]),
-			used: read(b[oPageUsed:]),
+			rank:    read(b[oPageRank:]),
+			size:    read(b[oPageSize:]),
+			used:    read(b[oPageUsed:]),
+			kind:    read(b[oPageKind:]),
+			logical: read(b[oPageLogical:]),
 		},
-	}
-	buffer.Put(p)
-	return m, nil
+	}, nil
 }
 
 func (a *Allocator) read(off int64) (int64, error) {
-	p := buffer.Get(8)
-	b := *p
-	if n, err := a.f.ReadAt(b, off); n != len(b) {
+	b, err := a.readCached(off, 8)
+	if err != nil {
 		return -1, err
 	}
 
-	n := read(b)
-	buffer.Put(p)
-	return n, nil
+	return read(b), nil
 }
 
 func (a *Allocator) sbrk(off int64, rank int) (int64, error) {
@@ -1011,5 +1099,26 @@ func (a *Allocator) usableSize(off int64) (int64, *memPage, error) {
 		return int64(1 << uint(p.rank+4)), p, nil
 	}
 
-	return p.size - szPage - szTail, p, nil
+	switch p.kind {
+	case pageRelocationStub:
+		target, err := a.read(off)
+		if err != nil {
+			return -1, nil, err
+		}
+
+		tp, err := a.openPage(target)
+		if err != nil {
+			return -1, nil, err
+		}
+
+		if tp.kind == pageCompressed {
+			return tp.logical, p, nil
+		}
+
+		return tp.size - szPage - szTail, p, nil
+	case pageCompressed:
+		return p.logical, p, nil
+	default:
+		return p.size - szPage - szTail, p, nil
+	}
 }
\ No newline at end of file
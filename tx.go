@@ -0,0 +1,165 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import "fmt"
+
+// Tx is a single allocator transaction, obtained from Begin, View or
+// Update. A writable Tx exposes Alloc/Free/Realloc/WriteAt in addition to
+// the read only ReadAt; a read only Tx returns an error from the mutating
+// methods. Rollback is best effort, not a full undo log: see its doc
+// comment before relying on a writable Tx for atomicity.
+type Tx struct {
+	a        *Allocator
+	writable bool
+	done     bool
+	pages    [ranks]int64
+	slots    [slotRanks]int64
+	fsize    int64
+}
+
+// Begin starts a writable transaction and returns it or an error, if any.
+// It blocks until any other in progress transaction, read only or
+// writable, completes; only one writable Tx can be in progress at a time,
+// mirroring the single writer discipline of a's free page/slot lists. The
+// caller must call Commit or Rollback to release it.
+func (a *Allocator) Begin() (*Tx, error) {
+	a.mu.Lock()
+	a.inTx = true
+	return &Tx{a: a, writable: true, pages: a.pages, slots: a.slots, fsize: a.fsize}, nil
+}
+
+// View runs fn in a read only transaction. Concurrent View calls do not
+// block each other; they only block out, and are blocked by, a writable
+// transaction. fn must not retain tx after it returns.
+func (a *Allocator) View(fn func(tx *Tx) error) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return fn(&Tx{a: a, pages: a.pages, slots: a.slots, fsize: a.fsize})
+}
+
+// Update runs fn in a writable transaction, committing the transaction if
+// fn returns nil and rolling it back otherwise. fn must not retain tx
+// after it returns.
+func (a *Allocator) Update(fn func(tx *Tx) error) error {
+	tx, err := a.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Commit makes the changes done through tx durable by writing out the
+// allocator header (the free page/slot list roots) and releases the write
+// lock taken by Begin. The individual page and node records tx's
+// Alloc/Free/Realloc/WriteAt calls touched were already written as they
+// happened; deferring only the header write is what makes the set of free
+// list root updates atomic from the point of view of a later NewAllocator.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("invalid argument: %T.Commit: transaction already closed", tx)
+	}
+
+	tx.done = true
+	defer tx.a.mu.Unlock()
+	tx.a.inTx = false
+	return tx.a.flushHeader()
+}
+
+// Rollback releases the write lock taken by Begin without writing the
+// allocator header, reverting tx.a's free page/slot list roots to their
+// state at Begin and truncating away any growth Alloc/Realloc appended to
+// the file since. It does not, and cannot, undo in-place writes
+// Free/Realloc/WriteAt already issued against pages that existed before
+// Begin; callers that need that guarantee must not let fn return an error
+// after it has called a mutating method on such a page.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return fmt.Errorf("invalid argument: %T.Rollback: transaction already closed", tx)
+	}
+
+	tx.done = true
+	defer tx.a.mu.Unlock()
+	tx.a.inTx = false
+	tx.a.pages = tx.pages
+	tx.a.slots = tx.slots
+	if tx.a.fsize > tx.fsize {
+		if err := tx.a.f.Truncate(tx.fsize); err != nil {
+			return err
+		}
+
+		if tx.a.cache != nil {
+			tx.a.cache.evictFrom(tx.fsize)
+		}
+
+		tx.a.fsize = tx.fsize
+	}
+	tx.a.dirty = true
+	return nil
+}
+
+// Alloc is like (*Allocator).Alloc, run as part of tx.
+func (tx *Tx) Alloc(size int64) (int64, error) {
+	if err := tx.writeCheck("Alloc"); err != nil {
+		return -1, err
+	}
+
+	return tx.a.alloc(size)
+}
+
+// Free is like (*Allocator).Free, run as part of tx.
+func (tx *Tx) Free(off int64) error {
+	if err := tx.writeCheck("Free"); err != nil {
+		return err
+	}
+
+	return tx.a.free(off)
+}
+
+// Realloc is like (*Allocator).Realloc, run as part of tx.
+func (tx *Tx) Realloc(off, size int64) (int64, error) {
+	if err := tx.writeCheck("Realloc"); err != nil {
+		return -1, err
+	}
+
+	return tx.a.realloc(off, size)
+}
+
+// ReadAt is like (*Allocator).ReadAt, run as part of tx.
+func (tx *Tx) ReadAt(off int64, b []byte) (int, error) {
+	if tx.done {
+		return 0, fmt.Errorf("invalid argument: %T.ReadAt: transaction already closed", tx)
+	}
+
+	return tx.a.readAt(off, b)
+}
+
+// WriteAt is like (*Allocator).WriteAt, run as part of tx.
+func (tx *Tx) WriteAt(off int64, b []byte) (int, error) {
+	if err := tx.writeCheck("WriteAt"); err != nil {
+		return 0, err
+	}
+
+	return tx.a.writeAt(off, b)
+}
+
+func (tx *Tx) writeCheck(method string) error {
+	if tx.done {
+		return fmt.Errorf("invalid argument: %T.%s: transaction already closed", tx, method)
+	}
+
+	if !tx.writable {
+		return fmt.Errorf("invalid argument: %T.%s: read only transaction", tx, method)
+	}
+
+	return nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import "fmt"
+
+// AllocStats provide a snapshot of the internal state of an Allocator as
+// collected by Verify.
+type AllocStats struct {
+	Handles     int64 // Number of live allocations.
+	TotalPages  int64 // Total number of pages found in the file.
+	AllocPages  int64 // Number of pages backing live allocations.
+	FreePages   int64 // Number of pages on the free page lists.
+	AllocBytes  int64 // Sum of the sizes of pages backing live allocations.
+	FreeBytes   int64 // Sum of the sizes of pages on the free page lists.
+	Relocations int64 // Number of live allocations relocated by compression.
+	CacheHits   int64 // Number of page cache hits so far, zero if caching is disabled.
+	CacheMisses int64 // Number of page cache misses so far, zero if caching is disabled.
+	AllocMap    map[int]int64 // rank -> number of allocated pages/slots of that rank.
+	FreeMap     map[int]int64 // rank -> number of free pages/slots of that rank.
+}
+
+// Verify checks a for structural corruption, returning the statistics it
+// collected along the way or the first error encountered.
+//
+// Verify walks the whole of the on disk structure starting at szFile,
+// advancing by each page's size field, and cross checks the free page
+// lists (a.pages) and free slot lists (a.slots) against what it observes
+// on disk.
+//
+// The optional bitmapf, when not nil, is invoked once for every offset
+// Verify considers live, i.e. every handle previously returned by
+// Alloc/Calloc/Realloc and not yet passed to Free. Callers can use it to
+// cross check the allocator state against an independently maintained
+// fsck-style bitmap. Verify is safe for concurrent use by multiple
+// goroutines; it runs under the same lock as a View transaction.
+func (a *Allocator) Verify(bitmapf func(off int64) error) (*AllocStats, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	freePages, err := a.verifyPageLists()
+	if err != nil {
+		return nil, err
+	}
+
+	freeSlots, err := a.verifySlotLists()
+	if err != nil {
+		return nil, err
+	}
+
+	relocTargets, err := a.verifyRelocations()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &AllocStats{
+		AllocMap: map[int]int64{},
+		FreeMap:  map[int]int64{},
+	}
+	if a.cache != nil {
+		stats.CacheHits = a.cache.hits
+		stats.CacheMisses = a.cache.misses
+	}
+
+	off := szFile
+	for off < a.fsize {
+		p, err := a.openPage(off)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.size <= 0 || off+p.size > a.fsize {
+			return nil, fmt.Errorf("corrupted file: page at %#x: invalid size %v", off, p.size)
+		}
+
+		tail, err := a.read(off + p.size - szTail)
+		if err != nil {
+			return nil, err
+		}
+
+		if freePages[off] {
+			if err := a.verifyFreePage(off, p, tail, stats); err != nil {
+				return nil, err
+			}
+		} else {
+			if err := a.verifyAllocPage(off, p, tail, freeSlots, relocTargets, stats, bitmapf); err != nil {
+				return nil, err
+			}
+		}
+
+		off += p.size
+	}
+
+	if off != a.fsize {
+		return nil, fmt.Errorf("corrupted file: last page ends at %#x, fsize is %#x", off, a.fsize)
+	}
+
+	return stats, nil
+}
+
+func (a *Allocator) verifyFreePage(off int64, p *memPage, tail int64, stats *AllocStats) error {
+	if p.used != 0 {
+		return fmt.Errorf("corrupted file: free page at %#x has used %v", off, p.used)
+	}
+
+	if tail != p.size {
+		return fmt.Errorf("corrupted file: free page at %#x: tail word %v, want %v", off, tail, p.size)
+	}
+
+	if p.rank > maxSharedRank {
+		if r := pageRank(p.size); r != int(p.rank) {
+			return fmt.Errorf("corrupted file: free page at %#x: rank %v, pageRank(size) %v", off, p.rank, r)
+		}
+	}
+
+	stats.TotalPages++
+	stats.FreePages++
+	stats.FreeBytes += p.size
+	stats.FreeMap[int(p.rank)]++
+	return nil
+}
+
+func (a *Allocator) verifyAllocPage(off int64, p *memPage, tail int64, freeSlots, relocTargets map[int64]bool, stats *AllocStats, bitmapf func(int64) error) error {
+	if tail != 0 {
+		return fmt.Errorf("corrupted file: allocated page at %#x: tail word %v, want 0", off, tail)
+	}
+
+	stats.TotalPages++
+	stats.AllocPages++
+	stats.AllocBytes += p.size
+	stats.AllocMap[int(p.rank)]++
+
+	if p.rank > maxSharedRank {
+		if r := pageRank(p.size); r != int(p.rank) {
+			return fmt.Errorf("corrupted file: big page at %#x: rank %v, pageRank(size) %v", off, p.rank, r)
+		}
+
+		if relocTargets[off] {
+			// This page only exists as the relocated, compressed
+			// storage for some other, still live handle; it is not
+			// itself a handle.
+			stats.Relocations++
+			return nil
+		}
+
+		stats.Handles++
+		if bitmapf != nil {
+			return bitmapf(off + szPage)
+		}
+		return nil
+	}
+
+	if int(p.rank) >= len(a.cap) {
+		return fmt.Errorf("corrupted file: shared page at %#x: invalid rank %v", off, p.rank)
+	}
+
+	if p.used < 0 || p.brk < p.used || int(p.brk) > a.cap[p.rank] {
+		return fmt.Errorf("corrupted file: shared page at %#x: used %v, brk %v, cap %v", off, p.used, p.brk, a.cap[p.rank])
+	}
+
+	for i := 0; i < int(p.brk); i++ {
+		so := p.slot(i)
+		if freeSlots[so] {
+			continue
+		}
+
+		stats.Handles++
+		if bitmapf != nil {
+			if err := bitmapf(so); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// verifyPageLists walks every rank's free page list, checking prev/next
+// reciprocity and that no page is listed more than once. It returns the
+// set of offsets found on the lists.
+func (a *Allocator) verifyPageLists() (map[int64]bool, error) {
+	free := map[int64]bool{}
+	for rank, head := range a.pages {
+		if rank < firstPageRank {
+			// a.pages[rank] for rank <= maxSharedRank is the current
+			// bump-allocation page for that rank, a live, partially used
+			// page, not a free list head; see alloc's sbrk. The main
+			// Verify loop already accounts for it via verifyAllocPage.
+			continue
+		}
+
+		prev := int64(0)
+		off := head
+		for off != 0 {
+			if free[off] {
+				return nil, fmt.Errorf("corrupted file: page %#x listed twice in the free page lists", off)
+			}
+
+			p, err := a.openPage(off)
+			if err != nil {
+				return nil, err
+			}
+
+			if int(p.rank) != rank {
+				return nil, fmt.Errorf("corrupted file: page %#x on rank %v free list has rank %v", off, rank, p.rank)
+			}
+
+			if p.prev != prev {
+				return nil, fmt.Errorf("corrupted file: page %#x: prev %#x, want %#x", off, p.prev, prev)
+			}
+
+			free[off] = true
+			prev = off
+			off = p.next
+		}
+	}
+	return free, nil
+}
+
+// verifyRelocations scans the file for relocation stub pages and returns
+// the set of offsets they point at, so the main pass can tell a relocation
+// target page apart from an ordinary live allocation.
+func (a *Allocator) verifyRelocations() (map[int64]bool, error) {
+	targets := map[int64]bool{}
+	off := szFile
+	for off < a.fsize {
+		p, err := a.openPage(off)
+		if err != nil {
+			return nil, err
+		}
+
+		if p.size <= 0 || off+p.size > a.fsize {
+			return nil, fmt.Errorf("corrupted file: page at %#x: invalid size %v", off, p.size)
+		}
+
+		if p.kind == pageRelocationStub {
+			target, err := a.read(off + szPage)
+			if err != nil {
+				return nil, err
+			}
+
+			if target <= szFile || target >= a.fsize {
+				return nil, fmt.Errorf("corrupted file: relocation stub at %#x: invalid target %#x", off, target)
+			}
+
+			if targets[target] {
+				return nil, fmt.Errorf("corrupted file: page %#x is the relocation target of more than one handle", target)
+			}
+
+			targets[target] = true
+		}
+
+		off += p.size
+	}
+	return targets, nil
+}
+
+// verifySlotLists walks every rank's free slot list, checking prev/next
+// reciprocity and that no slot is listed more than once. It returns the
+// set of slot offsets found on the lists.
+func (a *Allocator) verifySlotLists() (map[int64]bool, error) {
+	free := map[int64]bool{}
+	for _, head := range a.slots {
+		prev := int64(0)
+		off := head
+		for off != 0 {
+			if free[off] {
+				return nil, fmt.Errorf("corrupted file: slot %#x listed twice in the free slot lists", off)
+			}
+
+			n, err := a.openNode(off)
+			if err != nil {
+				return nil, err
+			}
+
+			if n.prev != prev {
+				return nil, fmt.Errorf("corrupted file: slot %#x: prev %#x, want %#x", off, n.prev, prev)
+			}
+
+			free[off] = true
+			prev = off
+			off = n.next
+		}
+	}
+	return free, nil
+}
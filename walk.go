@@ -0,0 +1,94 @@
+// Copyright 2017 The File Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import "fmt"
+
+// Walk visits every currently live allocation in a in offset order,
+// calling fn with the handle and usable size of each. Unlike Verify, Walk
+// assumes a is healthy and only enumerates what is live; it gives callers
+// such as backup tools or GC-style compactors a way to discover handles
+// without maintaining their own registry. Walk is safe for concurrent use
+// by multiple goroutines.
+func (a *Allocator) Walk(fn func(off, size int64) error) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	freePages, err := a.verifyPageLists()
+	if err != nil {
+		return err
+	}
+
+	relocTargets, err := a.verifyRelocations()
+	if err != nil {
+		return err
+	}
+
+	off := szFile
+	for off < a.fsize {
+		p, err := a.openPage(off)
+		if err != nil {
+			return err
+		}
+
+		if p.size <= 0 || off+p.size > a.fsize {
+			return fmt.Errorf("corrupted file: page at %#x: invalid size %v", off, p.size)
+		}
+
+		switch {
+		case freePages[off]:
+			// Not live, nothing to yield.
+		case p.rank > maxSharedRank:
+			if !relocTargets[off] {
+				size, _, err := a.usableSize(off + szPage)
+				if err != nil {
+					return err
+				}
+
+				if err := fn(off+szPage, size); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := a.walkSlots(p, fn); err != nil {
+				return err
+			}
+		}
+
+		off += p.size
+	}
+	return nil
+}
+
+// walkSlots yields every used slot of the shared page p.
+func (a *Allocator) walkSlots(p *memPage, fn func(off, size int64) error) error {
+	free := map[int64]bool{}
+	off := a.slots[p.rank]
+	for off != 0 {
+		if (off-szFile)&^pageMask+szFile == p.off {
+			free[off] = true
+		}
+
+		n, err := a.openNode(off)
+		if err != nil {
+			return err
+		}
+
+		off = n.next
+	}
+
+	size := int64(1) << uint(p.rank+4)
+	for i := 0; i < int(p.brk); i++ {
+		so := p.slot(i)
+		if free[so] {
+			continue
+		}
+
+		if err := fn(so, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}